@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -8,6 +10,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// errMFAMethodNotSupported is returned by a provider when a caller invokes
+// a capability (challenge/response, polling, ...) the provider does not
+// implement for the requested method.
+var errMFAMethodNotSupported = errors.New("mfa method not supported by provider")
+
 const mfaLoginFieldName = "mfa-token"
 
 var mfaLoginField = loginField{
@@ -20,6 +27,16 @@ var mfaLoginField = loginField{
 type mfaConfig struct {
 	Provider   string                 `yaml:"provider"`
 	Attributes map[string]interface{} `yaml:"attributes"`
+
+	// Strength is an operator-assigned weight (higher is stronger) used
+	// by mfaPolicy rules to tell a hardware key apart from a backup
+	// code. Zero means "unrated" and never satisfies a min_strength
+	// rule.
+	Strength int `yaml:"strength"`
+
+	// Tags lets a policy rule target methods by label (e.g. "hardware",
+	// "backup") instead of only by strength.
+	Tags []string `yaml:"tags"`
 }
 
 func (m mfaConfig) AttributeInt(key string) int {
@@ -54,8 +71,112 @@ type mfaProvider interface {
 	Configure(yamlSource []byte) (err error)
 
 	// ValidateMFA takes the user from the login cookie and performs a
-	// validation against the provided MFA configuration for this user
-	ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error
+	// validation against the provided MFA configuration for this user.
+	// This is the legacy single-phase path: the response is expected to
+	// be submitted alongside the primary credentials (see mfaLoginField)
+	// and is still the only path TOTP needs. On success it must return
+	// the specific mfaCfg entries that were actually used to validate
+	// the user (usually exactly one), not every entry it owns, so
+	// evaluateMFAPolicy credits the strength/tags of the method the user
+	// actually presented rather than the strongest one they merely have
+	// configured.
+	ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) (matched []mfaConfig, err error)
+
+	// Describe returns a descriptor for every mfaCfg entry this provider
+	// is responsible for (matched by the Provider field). It is used to
+	// populate the method chooser of the two-phase login flow and must
+	// not have side effects.
+	Describe(mfaCfgs []mfaConfig) (methods []mfaMethodDescriptor)
+
+	// ValidateMFAResponse completes phase 2 of the two-phase login flow
+	// started through Describe / POST /mfa/login: reqID identifies the
+	// pending request, methodID the descriptor the user picked, and
+	// payload carries the provider-specific response. On success it must
+	// return the specific mfaCfg entries the response actually validated
+	// against (mirroring ValidateMFA's matched return), not merely the
+	// one methodID names: a provider whose challenge admits more than
+	// one of the user's configs (WebAuthn's allowCredentials lists every
+	// registered key) cannot let the caller infer which key answered
+	// from methodID alone, or a client could claim credit for a
+	// stronger config than the one it actually used. Providers which
+	// only support the legacy ValidateMFA path must return
+	// errMFAMethodNotSupported.
+	ValidateMFAResponse(reqID, methodID string, payload json.RawMessage) (matched []mfaConfig, err error)
+
+	// BeginMFA issues the out-of-band challenge (e.g. a WebAuthn
+	// navigator.credentials.get() options object, or a Duo-style push
+	// notification) for methodID, one of the descriptors Describe
+	// returned for mfaCfgs, and associates it with reqID so the matching
+	// ValidateMFAResponse or PollMFA call can pick it back up. A provider
+	// that only ever has one eligible config per user (or treats every
+	// config as interchangeable, as WebAuthn does by listing every
+	// credential in the same allowCredentials challenge) may ignore
+	// methodID; a provider that dispatches to a specific device (push)
+	// must use it to pick out the right mfaCfg entry. methodMeta is
+	// opaque to the caller and only meaningful to the provider itself.
+	// Providers that can be satisfied by a bare payload without a
+	// preceding challenge must return errMFAMethodNotSupported.
+	BeginMFA(reqID, methodID, user string, mfaCfgs []mfaConfig) (challenge []byte, methodMeta interface{}, err error)
+
+	// PollMFA reports the current state of an out-of-band request
+	// started through BeginMFA, for providers (push notifications) whose
+	// approval happens asynchronously and is observed by polling rather
+	// than by a client-submitted payload. Providers that complete
+	// synchronously through ValidateMFA/ValidateMFAResponse must return
+	// errMFAMethodNotSupported.
+	PollMFA(reqID string) (state mfaPollState, err error)
+}
+
+// mfaPollState is the outcome of a PollMFA call.
+type mfaPollState string
+
+const (
+	mfaPollStateUnknown  mfaPollState = ""
+	mfaPollStatePending  mfaPollState = "pending"
+	mfaPollStateApproved mfaPollState = "approved"
+	mfaPollStateDenied   mfaPollState = "denied"
+	mfaPollStateTimeout  mfaPollState = "timeout"
+
+	// mfaPollStateError reports that the provider could not determine an
+	// outcome at all (e.g. the vendor API was unreachable), as distinct
+	// from mfaPollStateDenied, which means the vendor positively
+	// rejected the request. Collapsing the two would tell the user "you
+	// denied this login" when the real story is "we couldn't ask".
+	mfaPollStateError mfaPollState = "error"
+
+	// mfaPollStateMoreMethodsRequired is reported by handleMFAStatus (not
+	// by a provider's own PollMFA) when the approved push satisfied the
+	// provider but mfaPolicy's require_distinct_methods rule for the user
+	// still needs another, different method validated before the login
+	// can complete.
+	mfaPollStateMoreMethodsRequired mfaPollState = "more_methods_required"
+)
+
+// mfaLegacySingleFactor is meant to be embedded by providers (such as
+// the existing TOTP provider) that only ever implement the original
+// synchronous ValidateMFA contract, so extending mfaProvider with the
+// two-phase methods below doesn't force every pre-existing provider to
+// grow four new method bodies just to keep compiling. Describe reports
+// no descriptors, which keeps the method invisible to the two-phase
+// chooser: it still only works through the legacy inline mfa-token
+// field. ValidateMFAResponse/BeginMFA/PollMFA all report
+// errMFAMethodNotSupported.
+type mfaLegacySingleFactor struct{}
+
+func (mfaLegacySingleFactor) Describe(mfaCfgs []mfaConfig) []mfaMethodDescriptor {
+	return nil
+}
+
+func (mfaLegacySingleFactor) ValidateMFAResponse(reqID, methodID string, payload json.RawMessage) ([]mfaConfig, error) {
+	return nil, errMFAMethodNotSupported
+}
+
+func (mfaLegacySingleFactor) BeginMFA(reqID, methodID, user string, mfaCfgs []mfaConfig) ([]byte, interface{}, error) {
+	return nil, nil, errMFAMethodNotSupported
+}
+
+func (mfaLegacySingleFactor) PollMFA(reqID string) (mfaPollState, error) {
+	return mfaPollStateUnknown, errMFAMethodNotSupported
 }
 
 var (
@@ -91,9 +212,26 @@ func initializeMFAProviders(yamlSource []byte) error {
 		}
 	}
 
+	if err := initializeMFAPolicy(yamlSource); err != nil {
+		return fmt.Errorf("MFA policy configuration caused an error: %s", err)
+	}
+
+	if err := initializeMFARequestStore(yamlSource); err != nil {
+		return fmt.Errorf("MFA request store configuration caused an error: %s", err)
+	}
+
 	return nil
 }
 
+// mfaValidation records that a provider accepted the user for one
+// specific mfaCfg entry, so validateMFA can evaluate the result against
+// mfaPolicy instead of stopping at the first success.
+type mfaValidation struct {
+	ProviderID string
+	Strength   int
+	Tags       []string
+}
+
 func validateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
 	if len(mfaCfgs) == 0 {
 		// User has no configured MFA devices, their MFA is automatically valid
@@ -103,19 +241,30 @@ func validateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs
 	mfaRegistryMutex.RLock()
 	defer mfaRegistryMutex.RUnlock()
 
+	var validations []mfaValidation
+
 	for _, m := range activeMFAProviders {
-		err := m.ValidateMFA(res, r, user, mfaCfgs)
+		matched, err := m.ValidateMFA(res, r, user, mfaCfgs)
 		switch err {
 		case nil:
-			// Validated successfully
-			return nil
-		case errNoValidUserFound:
+			// Validated successfully: credit only the specific mfaCfg
+			// entries the provider reports it matched against, not every
+			// entry it owns, so a weak backup method can't borrow a
+			// hardware key's strength.
+			for _, c := range matched {
+				validations = append(validations, mfaValidation{ProviderID: m.ProviderID(), Strength: c.Strength, Tags: c.Tags})
+			}
+		case errNoValidUserFound, errMFAMethodNotSupported:
 			// This is fine for now
 		default:
 			return err
 		}
 	}
 
-	// No method could verify the user
-	return errNoValidUserFound
+	if len(validations) == 0 {
+		// No method could verify the user
+		return errNoValidUserFound
+	}
+
+	return evaluateMFAPolicy(user, validations)
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mfaMethodIDSeparator joins a provider ID and a per-provider method
+// index into the opaque method_id handed to clients.
+const mfaMethodIDSeparator = "#"
+
+// buildMFAMethodID builds the opaque method_id for the idx'th mfaCfg a
+// provider is describing.
+func buildMFAMethodID(providerID string, idx int) string {
+	return providerID + mfaMethodIDSeparator + strconv.Itoa(idx)
+}
+
+// mfaProviderIDFromMethodID extracts the provider ID portion of a
+// method_id produced by buildMFAMethodID.
+func mfaProviderIDFromMethodID(methodID string) (providerID string, ok bool) {
+	providerID, _, ok = strings.Cut(methodID, mfaMethodIDSeparator)
+	return providerID, ok && providerID != ""
+}
+
+// mfaConfigIndexFromMethodID extracts the mfaCfgs index portion of a
+// method_id produced by buildMFAMethodID, so a provider that manages
+// several interchangeable devices (e.g. push) can tell which one of the
+// user's configs the client actually picked.
+func mfaConfigIndexFromMethodID(methodID string) (idx int, ok bool) {
+	_, idxPart, found := strings.Cut(methodID, mfaMethodIDSeparator)
+	if !found {
+		return 0, false
+	}
+
+	idx, err := strconv.Atoi(idxPart)
+	if err != nil {
+		return 0, false
+	}
+
+	return idx, true
+}
+
+// mfaValidationForMethod builds the mfaValidation to credit for a
+// completed methodID, pulling the strength/tags from the one mfaCfg
+// entry the method_id actually names rather than every config the
+// provider owns.
+func mfaValidationForMethod(providerID, methodID string, mfaCfgs []mfaConfig) mfaValidation {
+	idx, ok := mfaConfigIndexFromMethodID(methodID)
+	if !ok || idx < 0 || idx >= len(mfaCfgs) {
+		return mfaValidation{ProviderID: providerID}
+	}
+
+	c := mfaCfgs[idx]
+
+	return mfaValidation{ProviderID: providerID, Strength: c.Strength, Tags: c.Tags}
+}
+
+// writeMFARequestStoreError reports err from a store Get/Update call:
+// errMFARequestNotFound means the pending request is genuinely gone
+// (expired or never existed) and is a 404, but any other error (e.g. a
+// redis backend giving up after exhausting its update-contention
+// retries) is a transient store failure, not a missing request, and
+// must not be reported the same way or the client will abandon a
+// still-valid login instead of retrying.
+func writeMFARequestStoreError(res http.ResponseWriter, err error) {
+	if errors.Is(err, errMFARequestNotFound) {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Error(res, "unable to access mfa request state", http.StatusInternalServerError)
+}
+
+type mfaChallengeRequest struct {
+	MFARequestID string `json:"mfa_request_id"`
+	MethodID     string `json:"method_id"`
+}
+
+type mfaChallengeJSONResponse struct {
+	Challenge json.RawMessage `json:"challenge"`
+}
+
+// handleMFAChallenge implements POST /mfa/challenge: given a pending
+// phase-1 request and the method the user picked, it asks the matching
+// provider to issue its out-of-band challenge (e.g. a WebAuthn
+// navigator.credentials.get() options object).
+func handleMFAChallenge(res http.ResponseWriter, r *http.Request) {
+	var req mfaChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(res, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	pr, err := getMFAPendingRequest(req.MFARequestID)
+	if err != nil {
+		writeMFARequestStoreError(res, err)
+		return
+	}
+
+	providerID, ok := mfaProviderIDFromMethodID(req.MethodID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	provider, ok := findMFAProvider(providerID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	challenge, _, err := provider.BeginMFA(pr.ID, req.MethodID, pr.User, pr.Configs)
+	if err != nil {
+		http.Error(res, "unable to begin mfa challenge", http.StatusInternalServerError)
+		return
+	}
+
+	if err := selectMFAPendingRequestMethod(pr.ID, req.MethodID); err != nil {
+		writeMFARequestStoreError(res, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(mfaChallengeJSONResponse{Challenge: challenge})
+}
+
+type mfaStatusJSONResponse struct {
+	State mfaPollState `json:"state"`
+}
+
+// handleMFAStatus implements GET /mfa/status?req=<mfa_request_id>, the
+// polling endpoint for out-of-band methods (push notifications) whose
+// approval is observed asynchronously rather than submitted as a
+// payload. Once the state is terminal the pending request is resolved:
+// on approval the login is completed if mfaPolicy is satisfied (else
+// more_methods_required is reported and the request stays pending), on
+// denial/timeout/error it is dropped (error meaning the provider itself could not reach a verdict,
+// e.g. the vendor API was unreachable, as distinct from an explicit
+// denial).
+func handleMFAStatus(res http.ResponseWriter, r *http.Request) {
+	reqID := r.URL.Query().Get("req")
+
+	pr, err := getMFAPendingRequest(reqID)
+	if err != nil {
+		writeMFARequestStoreError(res, err)
+		return
+	}
+
+	if pr.SelectedMethodID == "" {
+		http.Error(res, "no method selected for this request", http.StatusBadRequest)
+		return
+	}
+
+	providerID, ok := mfaProviderIDFromMethodID(pr.SelectedMethodID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	provider, ok := findMFAProvider(providerID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	state, err := provider.PollMFA(pr.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"mfa_provider": providerID, "user": pr.User}).WithError(err).Error("MFA poll failed")
+		http.Error(res, "unable to poll mfa state", http.StatusInternalServerError)
+		return
+	}
+
+	switch state {
+	case mfaPollStateApproved:
+		validation := mfaValidationForMethod(providerID, pr.SelectedMethodID, pr.Configs)
+
+		updated, err := recordMFAPendingRequestValidation(pr.ID, validation)
+		if err != nil {
+			writeMFARequestStoreError(res, err)
+			return
+		}
+
+		if err := evaluateMFAPolicy(updated.User, updated.Validations); err != nil {
+			res.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(res).Encode(mfaStatusJSONResponse{State: mfaPollStateMoreMethodsRequired})
+			return
+		}
+
+		deleteMFAPendingRequest(pr.ID)
+		if err := completeLogin(res, r, pr.User); err != nil {
+			http.Error(res, "unable to complete login", http.StatusInternalServerError)
+			return
+		}
+	case mfaPollStateDenied, mfaPollStateTimeout, mfaPollStateError:
+		deleteMFAPendingRequest(pr.ID)
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(mfaStatusJSONResponse{State: state})
+	default:
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(mfaStatusJSONResponse{State: state})
+	}
+}
+
+type mfaMethodsJSONResponse struct {
+	Methods []mfaMethodDescriptor `json:"methods"`
+}
+
+// handleMFAMethods implements GET /mfa/methods?mfa_request_id=..., a
+// read-only re-fetch of the method chooser data already handed back by
+// phase 1 of the login flow. It lets a login UI redraw the chooser
+// (e.g. after the user navigates back) without resubmitting the
+// primary credentials.
+func handleMFAMethods(res http.ResponseWriter, r *http.Request) {
+	pr, err := getMFAPendingRequest(r.URL.Query().Get("mfa_request_id"))
+	if err != nil {
+		writeMFARequestStoreError(res, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(mfaMethodsJSONResponse{Methods: pr.Methods})
+}
+
+type mfaValidateRequest struct {
+	MFARequestID string          `json:"mfa_request_id"`
+	MethodID     string          `json:"method_id"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// mfaValidateJSONResponse is the body returned by /mfa/validate when the
+// submitted method was itself accepted but mfaPolicy still requires
+// another, distinct method before the login completes (Done: false,
+// with the still-eligible methods to choose from). On a completed login
+// the handler issues the SSO cookie directly and returns no body.
+type mfaValidateJSONResponse struct {
+	Done    bool                  `json:"done"`
+	Methods []mfaMethodDescriptor `json:"methods,omitempty"`
+}
+
+// handleMFAValidate implements POST /mfa/validate, the phase-2 endpoint
+// of the two-phase login flow: it looks up the pending request created
+// by beginMFAChallenge, dispatches the response to the chosen provider
+// and, once mfaPolicy is satisfied, completes the login. If the
+// provider accepts the response but a require_distinct_methods rule
+// still needs another method, the pending request stays alive and the
+// client is told to begin another method instead.
+func handleMFAValidate(res http.ResponseWriter, r *http.Request) {
+	var req mfaValidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(res, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	pr, err := getMFAPendingRequest(req.MFARequestID)
+	if err != nil {
+		writeMFARequestStoreError(res, err)
+		return
+	}
+
+	// req.MethodID must be the one method_id the client actually
+	// committed to via POST /mfa/challenge, not merely a well-formed
+	// method_id of its choosing: BeginMFA's challenge can admit more
+	// than the one config methodID names (WebAuthn's allowCredentials
+	// lists every registered key), so without this check a client could
+	// answer with a weak method while naming a stronger one it never
+	// touched.
+	if req.MethodID == "" || req.MethodID != pr.SelectedMethodID {
+		http.Error(res, "method_id does not match the selected mfa challenge", http.StatusBadRequest)
+		return
+	}
+
+	providerID, ok := mfaProviderIDFromMethodID(req.MethodID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	provider, ok := findMFAProvider(providerID)
+	if !ok {
+		http.Error(res, "unknown method_id", http.StatusBadRequest)
+		return
+	}
+
+	matched, err := provider.ValidateMFAResponse(pr.ID, req.MethodID, req.Payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mfa_provider": providerID,
+			"user":         pr.User,
+		}).WithError(err).Error("MFA challenge response rejected")
+		http.Error(res, "mfa validation failed", http.StatusForbidden)
+		return
+	}
+
+	// Credit strength/tags from the mfaCfg entries the provider reports
+	// it actually validated against, not from req.MethodID: the two can
+	// differ whenever a provider's challenge admits more of the user's
+	// configs than the one methodID names.
+	updated := pr
+	for _, c := range matched {
+		if c.Provider != providerID {
+			continue
+		}
+
+		updated, err = recordMFAPendingRequestValidation(pr.ID, mfaValidation{ProviderID: providerID, Strength: c.Strength, Tags: c.Tags})
+		if err != nil {
+			writeMFARequestStoreError(res, err)
+			return
+		}
+	}
+
+	if err := evaluateMFAPolicy(updated.User, updated.Validations); err != nil {
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(mfaValidateJSONResponse{Done: false, Methods: updated.Methods})
+		return
+	}
+
+	deleteMFAPendingRequest(pr.ID)
+
+	// Cookie issuance is owned by the login handler; it exposes
+	// completeLogin for flows (like this one) that validate the user
+	// outside of the original login request.
+	if err := completeLogin(res, r, pr.User); err != nil {
+		http.Error(res, "unable to complete login", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestBuildMFAMethodIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		providerID string
+		idx        int
+	}{
+		{"webauthn", 0},
+		{"push", 3},
+	}
+
+	for _, tt := range tests {
+		methodID := buildMFAMethodID(tt.providerID, tt.idx)
+
+		gotProvider, ok := mfaProviderIDFromMethodID(methodID)
+		if !ok || gotProvider != tt.providerID {
+			t.Errorf("mfaProviderIDFromMethodID(%q) = (%q, %v), want (%q, true)", methodID, gotProvider, ok, tt.providerID)
+		}
+
+		gotIdx, ok := mfaConfigIndexFromMethodID(methodID)
+		if !ok || gotIdx != tt.idx {
+			t.Errorf("mfaConfigIndexFromMethodID(%q) = (%d, %v), want (%d, true)", methodID, gotIdx, ok, tt.idx)
+		}
+	}
+}
+
+func TestMfaProviderIDFromMethodIDRejectsMalformed(t *testing.T) {
+	for _, methodID := range []string{"", "noseparator", "#3"} {
+		if _, ok := mfaProviderIDFromMethodID(methodID); ok {
+			t.Errorf("mfaProviderIDFromMethodID(%q) ok = true, want false", methodID)
+		}
+	}
+}
+
+func TestMfaConfigIndexFromMethodIDRejectsMalformed(t *testing.T) {
+	for _, methodID := range []string{"", "noseparator", "push#notanumber"} {
+		if _, ok := mfaConfigIndexFromMethodID(methodID); ok {
+			t.Errorf("mfaConfigIndexFromMethodID(%q) ok = true, want false", methodID)
+		}
+	}
+}
+
+func TestMfaValidationForMethod(t *testing.T) {
+	cfgs := []mfaConfig{
+		{Provider: mfaPushProviderID, Strength: 5, Tags: []string{"backup"}},
+		{Provider: mfaPushProviderID, Strength: 10, Tags: []string{"hardware"}},
+	}
+
+	got := mfaValidationForMethod(mfaPushProviderID, buildMFAMethodID(mfaPushProviderID, 1), cfgs)
+	want := mfaValidation{ProviderID: mfaPushProviderID, Strength: 10, Tags: []string{"hardware"}}
+
+	if got.ProviderID != want.ProviderID || got.Strength != want.Strength {
+		t.Errorf("mfaValidationForMethod() = %+v, want %+v", got, want)
+	}
+
+	// An out-of-range or malformed method_id must not credit any
+	// config's strength; it should come back unrated rather than
+	// silently picking another entry.
+	got = mfaValidationForMethod(mfaPushProviderID, "garbage", cfgs)
+	if got.Strength != 0 {
+		t.Errorf("mfaValidationForMethod() with malformed method_id = %+v, want Strength 0", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// errInsufficientMFAStrength is returned when the user satisfied at
+	// least one MFA method but none meets a rule's min_strength.
+	errInsufficientMFAStrength = errors.New("no validated MFA method meets the required strength")
+
+	// errInsufficientMFAMethods is returned when a rule requires more
+	// distinct methods than the user validated.
+	errInsufficientMFAMethods = errors.New("not enough distinct MFA methods validated")
+)
+
+// mfaPolicyRule gates a set of groups behind a minimum requirement. A
+// rule with no Groups applies to every user. Groups is matched against
+// userGroupMemberships(user).
+type mfaPolicyRule struct {
+	Groups []string `yaml:"groups"`
+
+	// MinStrength, when set, requires at least one validated method with
+	// Strength >= MinStrength.
+	MinStrength int `yaml:"min_strength"`
+
+	// RequireDistinctMethods, when set, requires at least this many
+	// distinct providers to have validated the user.
+	RequireDistinctMethods int `yaml:"require_distinct_methods"`
+}
+
+type mfaPolicy struct {
+	Rules []mfaPolicyRule `yaml:"rules"`
+}
+
+var (
+	activeMFAPolicy      mfaPolicy
+	activeMFAPolicyMutex sync.RWMutex
+)
+
+// initializeMFAPolicy (re-)loads the `mfa.policy` section of
+// config.yaml. An absent section means no additional policy is
+// enforced beyond "at least one configured method validated".
+func initializeMFAPolicy(yamlSource []byte) error {
+	cfg := struct {
+		MFA struct {
+			Policy mfaPolicy `yaml:"policy"`
+		} `yaml:"mfa"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &cfg); err != nil {
+		return err
+	}
+
+	activeMFAPolicyMutex.Lock()
+	activeMFAPolicy = cfg.MFA.Policy
+	activeMFAPolicyMutex.Unlock()
+
+	return nil
+}
+
+// evaluateMFAPolicy checks the validations collected by validateMFA
+// against every rule whose Groups intersect the user's groups.
+func evaluateMFAPolicy(user string, validations []mfaValidation) error {
+	activeMFAPolicyMutex.RLock()
+	rules := activeMFAPolicy.Rules
+	activeMFAPolicyMutex.RUnlock()
+
+	groups := userGroupMemberships(user)
+
+	for _, rule := range rules {
+		if len(rule.Groups) > 0 && !stringSlicesIntersect(rule.Groups, groups) {
+			continue
+		}
+
+		if rule.MinStrength > 0 && !mfaValidationsMeetStrength(validations, rule.MinStrength) {
+			return errInsufficientMFAStrength
+		}
+
+		if rule.RequireDistinctMethods > 0 && mfaDistinctProviderCount(validations) < rule.RequireDistinctMethods {
+			return errInsufficientMFAMethods
+		}
+	}
+
+	return nil
+}
+
+func mfaValidationsMeetStrength(validations []mfaValidation, minStrength int) bool {
+	for _, v := range validations {
+		if v.Strength >= minStrength {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mfaDistinctProviderCount(validations []mfaValidation) int {
+	seen := map[string]struct{}{}
+	for _, v := range validations {
+		seen[v.ProviderID] = struct{}{}
+	}
+
+	return len(seen)
+}
+
+func stringSlicesIntersect(a, b []string) bool {
+	set := map[string]struct{}{}
+	for _, v := range a {
+		set[v] = struct{}{}
+	}
+
+	for _, v := range b {
+		if _, ok := set[v]; ok {
+			return true
+		}
+	}
+
+	return false
+}
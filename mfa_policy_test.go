@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestMfaValidationsMeetStrength(t *testing.T) {
+	validations := []mfaValidation{
+		{ProviderID: "totp", Strength: 1},
+		{ProviderID: "webauthn", Strength: 10},
+	}
+
+	tests := []struct {
+		name        string
+		validations []mfaValidation
+		minStrength int
+		want        bool
+	}{
+		{"empty validations never meet a positive minimum", nil, 1, false},
+		{"no validation reaches the minimum", validations, 20, false},
+		{"one validation exactly meets the minimum", validations, 10, true},
+		{"one validation exceeds the minimum", validations, 5, true},
+		{"minimum of zero is trivially met", validations, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mfaValidationsMeetStrength(tt.validations, tt.minStrength); got != tt.want {
+				t.Errorf("mfaValidationsMeetStrength() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMfaDistinctProviderCount(t *testing.T) {
+	tests := []struct {
+		name        string
+		validations []mfaValidation
+		want        int
+	}{
+		{"no validations", nil, 0},
+		{"single provider", []mfaValidation{{ProviderID: "totp"}}, 1},
+		{
+			"repeated provider counted once",
+			[]mfaValidation{{ProviderID: "totp", Strength: 1}, {ProviderID: "totp", Strength: 1}},
+			1,
+		},
+		{
+			"two distinct providers",
+			[]mfaValidation{{ProviderID: "totp"}, {ProviderID: "webauthn"}},
+			2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mfaDistinctProviderCount(tt.validations); got != tt.want {
+				t.Errorf("mfaDistinctProviderCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringSlicesIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want bool
+	}{
+		{"both empty", nil, nil, false},
+		{"no overlap", []string{"admins"}, []string{"users"}, false},
+		{"overlap", []string{"admins", "ops"}, []string{"users", "ops"}, true},
+		{"a empty", nil, []string{"users"}, false},
+		{"b empty", []string{"admins"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringSlicesIntersect(tt.a, tt.b); got != tt.want {
+				t.Errorf("stringSlicesIntersect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
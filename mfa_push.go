@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// mfaPushProviderID is the provider ID registered for this
+// authenticator (`provider: push` in a user's mfaConfig entries).
+const mfaPushProviderID = "push"
+
+// mfaPushTimeout is how long an issued push stays approvable before
+// PollMFA starts reporting mfaPollStateTimeout.
+const mfaPushTimeout = 60 * time.Second
+
+// mfaPushPollInterval is how often the background goroutine started by
+// BeginMFA checks the vendor API for a decision.
+const mfaPushPollInterval = 2 * time.Second
+
+func init() {
+	registerMFAProvider(newMFAPush())
+}
+
+type mfaPushConfig struct {
+	IntegrationKey string `yaml:"integration_key"`
+	SecretKey      string `yaml:"secret_key"`
+	APIHost        string `yaml:"api_host"`
+}
+
+type mfaPushTransaction struct {
+	state     mfaPollState
+	expiresAt time.Time
+}
+
+type mfaPush struct {
+	cfg *mfaPushConfig
+
+	client *http.Client
+
+	mutex        sync.Mutex
+	transactions map[string]*mfaPushTransaction
+}
+
+func newMFAPush() *mfaPush {
+	return &mfaPush{
+		transactions: map[string]*mfaPushTransaction{},
+	}
+}
+
+func (m *mfaPush) ProviderID() string { return mfaPushProviderID }
+
+// Configure only replaces m.cfg/m.client: m.transactions is seeded once
+// by newMFAPush and must survive a config reload (initializeMFAProviders
+// re-runs Configure on every reload), or a push still in flight at
+// reload time would vanish and the next /mfa/status poll for it would
+// fail an otherwise-valid pending login.
+func (m *mfaPush) Configure(yamlSource []byte) error {
+	cfg := struct {
+		MFA struct {
+			Push *mfaPushConfig `yaml:"push"`
+		} `yaml:"mfa"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &cfg); err != nil {
+		return err
+	}
+
+	if cfg.MFA.Push == nil {
+		return errProviderUnconfigured
+	}
+
+	m.cfg = cfg.MFA.Push
+	m.client = &http.Client{Timeout: 10 * time.Second}
+
+	return nil
+}
+
+// Describe lists one push descriptor per push-enrolled device the user
+// owns.
+func (m *mfaPush) Describe(mfaCfgs []mfaConfig) []mfaMethodDescriptor {
+	var methods []mfaMethodDescriptor
+
+	for i, c := range mfaCfgs {
+		if c.Provider != mfaPushProviderID {
+			continue
+		}
+
+		label := c.AttributeString("label")
+		if label == "" {
+			label = "Push Notification"
+		}
+
+		methods = append(methods, mfaMethodDescriptor{
+			ProviderID: mfaPushProviderID,
+			MethodID:   buildMFAMethodID(mfaPushProviderID, i),
+			MethodType: mfaMethodPush,
+			Label:      label,
+		})
+	}
+
+	return methods
+}
+
+// ValidateMFA is not supported: push approval is out-of-band and can
+// only be observed through PollMFA.
+func (m *mfaPush) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) ([]mfaConfig, error) {
+	return nil, errMFAMethodNotSupported
+}
+
+// ValidateMFAResponse is not supported for the same reason as
+// ValidateMFA: there is no client-submitted payload to verify.
+func (m *mfaPush) ValidateMFAResponse(reqID, methodID string, payload json.RawMessage) ([]mfaConfig, error) {
+	return nil, errMFAMethodNotSupported
+}
+
+// BeginMFA sends the push to the device identified by methodID (one of
+// the descriptors Describe returned) and starts a background goroutine
+// that polls the vendor API until the push is approved, denied, errors
+// out, or mfaPushTimeout elapses.
+func (m *mfaPush) BeginMFA(reqID, methodID, user string, mfaCfgs []mfaConfig) (challenge []byte, methodMeta interface{}, err error) {
+	deviceID, err := m.devicePushID(methodID, mfaCfgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txID, err := m.sendPush(user, deviceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to send push: %w", err)
+	}
+
+	tx := &mfaPushTransaction{state: mfaPollStatePending, expiresAt: time.Now().Add(mfaPushTimeout)}
+
+	m.mutex.Lock()
+	m.transactions[reqID] = tx
+	m.mutex.Unlock()
+
+	go m.watchPush(reqID, txID, user, tx.expiresAt)
+
+	// Belt-and-suspenders cleanup for transactions nobody ever polls
+	// (e.g. the user abandoned the tab): watchPush marks them timed out,
+	// but only PollMFA removes them from the map.
+	time.AfterFunc(mfaPushTimeout+mfaPushPollInterval, func() {
+		m.mutex.Lock()
+		delete(m.transactions, reqID)
+		m.mutex.Unlock()
+	})
+
+	return nil, txID, nil
+}
+
+// watchPush polls the vendor API for a decision on txID until it gets a
+// terminal state, the deadline passes, or it sees repeated network
+// errors, then records the outcome for PollMFA to pick up. Repeated
+// vendor/network errors resolve to mfaPollStateError, never
+// mfaPollStateDenied: the vendor never actually weighed in, so telling
+// the user "denied" would misreport an outage as their own rejection.
+func (m *mfaPush) watchPush(reqID, txID, user string, deadline time.Time) {
+	ticker := time.NewTicker(mfaPushPollInterval)
+	defer ticker.Stop()
+
+	var consecutiveErrors int
+	var lastErr error
+
+	for range ticker.C {
+		if time.Now().After(deadline) {
+			m.setTransactionState(reqID, mfaPollStateTimeout)
+			return
+		}
+
+		state, err := m.pollVendorAPI(txID)
+		if err != nil {
+			consecutiveErrors++
+			lastErr = err
+			if consecutiveErrors >= 3 {
+				log.WithFields(log.Fields{"mfa_provider": mfaPushProviderID, "user": user}).WithError(lastErr).Error("push vendor API unreachable, giving up on this transaction")
+				m.setTransactionState(reqID, mfaPollStateError)
+				return
+			}
+			continue
+		}
+		consecutiveErrors = 0
+
+		switch state {
+		case mfaPollStateApproved, mfaPollStateDenied:
+			m.setTransactionState(reqID, state)
+			return
+		}
+	}
+}
+
+func (m *mfaPush) setTransactionState(reqID string, state mfaPollState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if tx, ok := m.transactions[reqID]; ok {
+		tx.state = state
+	}
+}
+
+// PollMFA reports the current state of the push transaction started by
+// BeginMFA for reqID, cleaning it up once it reaches a terminal state.
+func (m *mfaPush) PollMFA(reqID string) (mfaPollState, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tx, ok := m.transactions[reqID]
+	if !ok {
+		return mfaPollStateUnknown, errMFARequestNotFound
+	}
+
+	switch tx.state {
+	case mfaPollStateApproved, mfaPollStateDenied, mfaPollStateTimeout, mfaPollStateError:
+		delete(m.transactions, reqID)
+	}
+
+	return tx.state, nil
+}
+
+// devicePushID resolves methodID (as produced by Describe via
+// buildMFAMethodID) to the device_id of the specific mfaCfg entry the
+// user picked, so a user enrolled with several push devices gets
+// buzzed on the one they selected rather than always the first.
+func (m *mfaPush) devicePushID(methodID string, mfaCfgs []mfaConfig) (string, error) {
+	idx, ok := mfaConfigIndexFromMethodID(methodID)
+	if !ok || idx < 0 || idx >= len(mfaCfgs) {
+		return "", errNoValidUserFound
+	}
+
+	c := mfaCfgs[idx]
+	if c.Provider != mfaPushProviderID {
+		return "", errNoValidUserFound
+	}
+
+	id := c.AttributeString("device_id")
+	if id == "" {
+		return "", errNoValidUserFound
+	}
+
+	return id, nil
+}
+
+// sendPush calls the vendor's "send push" API and returns the vendor
+// transaction ID used to poll for a decision.
+func (m *mfaPush) sendPush(user, deviceID string) (string, error) {
+	form := url.Values{
+		"username": {user},
+		"device":   {deviceID},
+		"factor":   {"push"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://"+m.cfg.APIHost+"/auth/v2/auth", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.SetBasicAuth(m.cfg.IntegrationKey, m.cfg.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", fmt.Errorf("push vendor API returned status %d", response.StatusCode)
+	}
+
+	var body struct {
+		Response struct {
+			TxID string `json:"txid"`
+		} `json:"response"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Response.TxID == "" {
+		return "", errors.New("push vendor API response missing txid")
+	}
+
+	return body.Response.TxID, nil
+}
+
+// pollVendorAPI calls the vendor's "auth status" API for txID.
+func (m *mfaPush) pollVendorAPI(txID string) (mfaPollState, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://"+m.cfg.APIHost+"/auth/v2/auth_status?txid="+txID, nil)
+	if err != nil {
+		return mfaPollStateUnknown, err
+	}
+
+	req.SetBasicAuth(m.cfg.IntegrationKey, m.cfg.SecretKey)
+
+	response, err := m.client.Do(req)
+	if err != nil {
+		return mfaPollStateUnknown, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return mfaPollStateUnknown, fmt.Errorf("push vendor API returned status %d", response.StatusCode)
+	}
+
+	var body struct {
+		Response struct {
+			Result string `json:"result"`
+		} `json:"response"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return mfaPollStateUnknown, err
+	}
+
+	switch body.Response.Result {
+	case "allow":
+		return mfaPollStateApproved, nil
+	case "deny":
+		return mfaPollStateDenied, nil
+	case "":
+		return mfaPollStateUnknown, errors.New("push vendor API response missing result")
+	default:
+		return mfaPollStatePending, nil
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errMFARequestNotFound = errors.New("mfa request not found or expired")
+)
+
+// mfaPendingRequestTTL is how long a phase-1 MFA request stays valid
+// waiting for a phase-2 response before it is garbage collected.
+const mfaPendingRequestTTL = 5 * time.Minute
+
+// mfaMethodType classifies how a method descriptor expects the client
+// to respond.
+type mfaMethodType string
+
+const (
+	// mfaMethodChallengeResponse methods expect the client to submit a
+	// payload (TOTP code, WebAuthn assertion, ...) to /mfa/validate.
+	mfaMethodChallengeResponse mfaMethodType = "challenge_response"
+	// mfaMethodPush methods are approved out-of-band; the client polls
+	// /mfa/status instead of submitting a payload.
+	mfaMethodPush mfaMethodType = "push"
+)
+
+// mfaMethodDescriptor describes a single MFA method a user can use to
+// complete phase 2 of the login flow.
+type mfaMethodDescriptor struct {
+	ProviderID string        `json:"provider_id"`
+	MethodID   string        `json:"method_id"`
+	MethodType mfaMethodType `json:"method_type"`
+	Label      string        `json:"label"`
+}
+
+// mfaChallengeResponse is the body returned by phase 1 of the login flow
+// when the user has at least one MFA method configured.
+type mfaChallengeResponse struct {
+	MFARequestID string                `json:"mfa_request_id"`
+	User         string                `json:"user"`
+	Methods      []mfaMethodDescriptor `json:"methods"`
+}
+
+// mfaPendingRequest is the server-side record created for a phase-1
+// login and consumed by the matching phase-2 call.
+type mfaPendingRequest struct {
+	ID        string
+	User      string
+	Methods   []mfaMethodDescriptor
+	Configs   []mfaConfig
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// SelectedMethodID is set once the client commits to a method via
+	// POST /mfa/challenge, so a later POST /mfa/validate or GET
+	// /mfa/status knows which provider to dispatch to without having to
+	// trust the client to repeat it accurately.
+	SelectedMethodID string
+
+	// Validations accumulates one entry per method the client has
+	// completed so far for this request. A policy rule that requires
+	// several distinct methods (see mfa_policy.go) is only satisfied
+	// once enough of them have been recorded here; until then the login
+	// is not completed and the client must begin another method.
+	Validations []mfaValidation
+}
+
+func generateMFARequestID() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate mfa request id: %w", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func putMFAPendingRequest(user string, methods []mfaMethodDescriptor, mfaCfgs []mfaConfig) (*mfaPendingRequest, error) {
+	id, err := generateMFARequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &mfaPendingRequest{
+		ID:        id,
+		User:      user,
+		Methods:   methods,
+		Configs:   mfaCfgs,
+		CreatedAt: time.Now(),
+	}
+
+	if err := currentMFARequestStore().Put(id, pr, mfaPendingRequestTTL); err != nil {
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+func getMFAPendingRequest(id string) (*mfaPendingRequest, error) {
+	return currentMFARequestStore().Get(id)
+}
+
+// selectMFAPendingRequestMethod records the method the client committed
+// to via POST /mfa/challenge.
+func selectMFAPendingRequestMethod(id, methodID string) error {
+	_, err := currentMFARequestStore().Update(id, func(pr *mfaPendingRequest) error {
+		pr.SelectedMethodID = methodID
+		return nil
+	})
+
+	return err
+}
+
+func deleteMFAPendingRequest(id string) {
+	_ = currentMFARequestStore().Delete(id)
+}
+
+// recordMFAPendingRequestValidation appends v to the request's
+// accumulated validations (used to evaluate mfaPolicy rules like
+// require_distinct_methods) and returns the updated request. It goes
+// through the store's Update rather than a Get/Put pair because the
+// two-phase flow allows more than one method to be validated
+// concurrently for the same request (e.g. polling an in-progress push
+// while a WebAuthn assertion is also being submitted), and a Get/Put
+// pair would let the slower write silently drop the faster one's
+// validation.
+func recordMFAPendingRequestValidation(id string, v mfaValidation) (*mfaPendingRequest, error) {
+	return currentMFARequestStore().Update(id, func(pr *mfaPendingRequest) error {
+		pr.Validations = append(pr.Validations, v)
+		return nil
+	})
+}
+
+// beginMFAChallenge is invoked by the login handler once the primary
+// credentials validated successfully. When the user has no MFA
+// configured it returns (nil, nil) so the caller can issue the SSO
+// cookie right away; otherwise it stores a pending request and returns
+// the phase-1 response describing the eligible methods.
+func beginMFAChallenge(user string, mfaCfgs []mfaConfig) (*mfaChallengeResponse, error) {
+	if len(mfaCfgs) == 0 {
+		return nil, nil
+	}
+
+	mfaRegistryMutex.RLock()
+	var methods []mfaMethodDescriptor
+	for _, m := range activeMFAProviders {
+		methods = append(methods, m.Describe(mfaCfgs)...)
+	}
+	mfaRegistryMutex.RUnlock()
+
+	if len(methods) == 0 {
+		return nil, errNoValidUserFound
+	}
+
+	pr, err := putMFAPendingRequest(user, methods, mfaCfgs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to store mfa request: %w", err)
+	}
+
+	return &mfaChallengeResponse{
+		MFARequestID: pr.ID,
+		User:         pr.User,
+		Methods:      pr.Methods,
+	}, nil
+}
+
+// findMFAProvider returns the active provider registered under id.
+func findMFAProvider(id string) (mfaProvider, bool) {
+	mfaRegistryMutex.RLock()
+	defer mfaRegistryMutex.RUnlock()
+
+	for _, m := range activeMFAProviders {
+		if m.ProviderID() == id {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var errUnknownMFARequestStoreBackend = errors.New("unknown mfa.request_store.backend, expected \"memory\" or \"redis\"")
+
+// mfaRequestStoreConfig selects and configures the MFARequestStore
+// backend via the `mfa.request_store` section of config.yaml.
+type mfaRequestStoreConfig struct {
+	Backend string              `yaml:"backend"`
+	Redis   mfaRedisStoreConfig `yaml:"redis"`
+}
+
+// MFARequestStore persists the pending MFA requests created by
+// beginMFAChallenge across the gap between phase 1 and phase 2 of the
+// login flow. It is the extension point that lets several nginx-sso
+// replicas behind a load balancer share pending requests regardless of
+// which instance handled phase 1. Provider-side challenge state (WebAuthn
+// sessions, push transactions) is not kept here but in the memory of the
+// instance that served POST /mfa/challenge, so the matching
+// /mfa/validate or /mfa/status call only succeeds on that same instance.
+type MFARequestStore interface {
+	Put(reqID string, record *mfaPendingRequest, ttl time.Duration) error
+	Get(reqID string) (*mfaPendingRequest, error)
+	Delete(reqID string) error
+
+	// Update atomically applies fn to the record stored under reqID and
+	// persists whatever fn leaves behind, preserving the record's
+	// existing TTL. The two-phase flow intentionally allows more than
+	// one method to be in flight for the same mfa_request_id at once
+	// (e.g. polling an in-progress push while also submitting a
+	// WebAuthn assertion), so a plain Get-then-Put pair layered on top
+	// of this interface would let the slower write silently clobber the
+	// faster one's change; implementations must make the whole
+	// read-modify-write indivisible instead. fn returning an error
+	// aborts the update and that error is returned as-is.
+	Update(reqID string, fn func(record *mfaPendingRequest) error) (*mfaPendingRequest, error)
+
+	// Close releases any background resources (janitor goroutines,
+	// network connections) held by the store. It is called when the
+	// store is replaced by a config reload.
+	Close() error
+}
+
+var (
+	mfaRequestStoreMutex sync.RWMutex
+	mfaRequestStore      MFARequestStore = newMemoryMFARequestStore()
+)
+
+// initializeMFARequestStore (re-)configures the pending-MFA-request
+// store from the `mfa.request_store` section of config.yaml. Absent
+// configuration keeps the in-memory default, which is fine for a single
+// instance but does not survive a restart or fan out across replicas.
+func initializeMFARequestStore(yamlSource []byte) error {
+	cfg := struct {
+		MFA struct {
+			RequestStore *mfaRequestStoreConfig `yaml:"request_store"`
+		} `yaml:"mfa"`
+		Cookie struct {
+			SignKey string `yaml:"sign_key"`
+		} `yaml:"cookie"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &cfg); err != nil {
+		return err
+	}
+
+	var store MFARequestStore
+
+	switch {
+	case cfg.MFA.RequestStore == nil || cfg.MFA.RequestStore.Backend == "" || cfg.MFA.RequestStore.Backend == "memory":
+		if _, ok := currentMFARequestStore().(*memoryMFARequestStore); ok {
+			// Already in-memory: keep it so pending requests survive a reload.
+			return nil
+		}
+		store = newMemoryMFARequestStore()
+
+	case cfg.MFA.RequestStore.Backend == "redis":
+		var err error
+		store, err = newRedisMFARequestStore(cfg.MFA.RequestStore.Redis, []byte(cfg.Cookie.SignKey))
+		if err != nil {
+			return err
+		}
+
+	default:
+		return errUnknownMFARequestStoreBackend
+	}
+
+	mfaRequestStoreMutex.Lock()
+	previous := mfaRequestStore
+	mfaRequestStore = store
+	mfaRequestStoreMutex.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			log.WithError(err).Warn("Unable to cleanly close the previous MFA request store")
+		}
+	}
+
+	return nil
+}
+
+func currentMFARequestStore() MFARequestStore {
+	mfaRequestStoreMutex.RLock()
+	defer mfaRequestStoreMutex.RUnlock()
+
+	return mfaRequestStore
+}
+
+// memoryMFARequestStore is the default MFARequestStore: adequate for a
+// single nginx-sso instance, lost on restart, not shared across
+// replicas.
+type memoryMFARequestStore struct {
+	mutex    sync.Mutex
+	data     map[string]*mfaPendingRequest
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newMemoryMFARequestStore() *memoryMFARequestStore {
+	s := &memoryMFARequestStore{
+		data: map[string]*mfaPendingRequest{},
+		stop: make(chan struct{}),
+	}
+	go s.janitor()
+
+	return s
+}
+
+func (s *memoryMFARequestStore) Put(reqID string, record *mfaPendingRequest, ttl time.Duration) error {
+	record.ExpiresAt = time.Now().Add(ttl)
+
+	// Store our own copy: callers must not be able to mutate the record
+	// we hand back from Get without going through Put, or a concurrent
+	// Get/Put pair would race on the same struct.
+	stored := *record
+
+	s.mutex.Lock()
+	s.data[reqID] = &stored
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *memoryMFARequestStore) Get(reqID string) (*mfaPendingRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.data[reqID]
+	if !ok {
+		return nil, errMFARequestNotFound
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		delete(s.data, reqID)
+		return nil, errMFARequestNotFound
+	}
+
+	// Return a copy so the caller can only change what's visible to
+	// other callers by round-tripping it through Put.
+	cpy := *record
+
+	return &cpy, nil
+}
+
+// Update holds the store's single mutex across the whole
+// read-modify-write, so it is naturally atomic with respect to every
+// other Get/Put/Delete/Update call on the same store.
+func (s *memoryMFARequestStore) Update(reqID string, fn func(record *mfaPendingRequest) error) (*mfaPendingRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.data[reqID]
+	if !ok {
+		return nil, errMFARequestNotFound
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		delete(s.data, reqID)
+		return nil, errMFARequestNotFound
+	}
+
+	updated := *record
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+
+	s.data[reqID] = &updated
+
+	cpy := updated
+
+	return &cpy, nil
+}
+
+func (s *memoryMFARequestStore) Delete(reqID string) error {
+	s.mutex.Lock()
+	delete(s.data, reqID)
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// Close stops the janitor goroutine. The in-memory data is discarded
+// with the store itself.
+func (s *memoryMFARequestStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	return nil
+}
+
+// janitor periodically evicts expired pending requests so an abandoned
+// login flow doesn't leak memory.
+func (s *memoryMFARequestStore) janitor() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			s.mutex.Lock()
+			for id, record := range s.data {
+				if now.After(record.ExpiresAt) {
+					delete(s.data, id)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mfaRedisStoreConfig configures the redis MFARequestStore backend.
+type mfaRedisStoreConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// mfaRedisKeyPrefix namespaces pending-MFA-request keys in a shared
+// Redis instance.
+const mfaRedisKeyPrefix = "nginx-sso:mfa-request:"
+
+// redisMFARequestStore shares pending MFA requests across nginx-sso
+// replicas through Redis. Records are AES-GCM encrypted before they
+// leave the process so that a Redis compromise alone does not leak
+// pending auth state (user name, eligible methods, ...).
+type redisMFARequestStore struct {
+	client *redis.Client
+	aead   cipher.AEAD
+}
+
+func newRedisMFARequestStore(cfg mfaRedisStoreConfig, cookieSigningSecret []byte) (*redisMFARequestStore, error) {
+	if len(cookieSigningSecret) == 0 {
+		return nil, errors.New("cannot set up the redis mfa request store without a cookie signing secret")
+	}
+
+	block, err := aes.NewCipher(deriveMFARequestEncryptionKey(cookieSigningSecret))
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize mfa request encryption: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize mfa request encryption: %w", err)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	return &redisMFARequestStore{client: client, aead: aead}, nil
+}
+
+// deriveMFARequestEncryptionKey derives a 32-byte AES-256 key from the
+// cookie-signing secret so operators do not need a second secret just
+// for this store.
+func deriveMFARequestEncryptionKey(cookieSigningSecret []byte) []byte {
+	sum := sha256.Sum256(append([]byte("nginx-sso:mfa-request-store:"), cookieSigningSecret...))
+	return sum[:]
+}
+
+func (s *redisMFARequestStore) Put(reqID string, record *mfaPendingRequest, ttl time.Duration) error {
+	record.ExpiresAt = time.Now().Add(ttl)
+
+	plain, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := s.encrypt(plain)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(context.Background(), mfaRedisKeyPrefix+reqID, ciphertext, ttl).Err()
+}
+
+func (s *redisMFARequestStore) Get(reqID string) (*mfaPendingRequest, error) {
+	ciphertext, err := s.client.Get(context.Background(), mfaRedisKeyPrefix+reqID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errMFARequestNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	plain, err := s.decrypt(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt mfa request record: %w", err)
+	}
+
+	var record mfaPendingRequest
+	if err := json.Unmarshal(plain, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (s *redisMFARequestStore) Delete(reqID string) error {
+	return s.client.Del(context.Background(), mfaRedisKeyPrefix+reqID).Err()
+}
+
+// mfaRedisUpdateMaxAttempts bounds how many attempts Update makes (the
+// first try plus retries after losing the optimistic-locking race on a
+// key) before giving up.
+const mfaRedisUpdateMaxAttempts = 10
+
+// Update uses a WATCH/MULTI transaction to make the read-modify-write
+// indivisible across replicas: if another Update (or Put) changes the
+// key between our GET and EXEC, redis aborts the transaction with
+// redis.TxFailedErr and we retry with the now-current record rather
+// than silently overwriting the other writer's change.
+func (s *redisMFARequestStore) Update(reqID string, fn func(record *mfaPendingRequest) error) (*mfaPendingRequest, error) {
+	ctx := context.Background()
+	key := mfaRedisKeyPrefix + reqID
+
+	for attempt := 0; attempt < mfaRedisUpdateMaxAttempts; attempt++ {
+		var updated *mfaPendingRequest
+
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			ciphertext, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return errMFARequestNotFound
+			} else if err != nil {
+				return err
+			}
+
+			plain, err := s.decrypt(ciphertext)
+			if err != nil {
+				return fmt.Errorf("unable to decrypt mfa request record: %w", err)
+			}
+
+			var record mfaPendingRequest
+			if err := json.Unmarshal(plain, &record); err != nil {
+				return err
+			}
+
+			if err := fn(&record); err != nil {
+				return err
+			}
+
+			newPlain, err := json.Marshal(&record)
+			if err != nil {
+				return err
+			}
+
+			newCiphertext, err := s.encrypt(newPlain)
+			if err != nil {
+				return err
+			}
+
+			// go-redis's Set treats a zero/negative expiration as "no
+			// expiration" rather than "already expired", so a record
+			// whose ExpiresAt has already passed by the time we get
+			// here (contention retries, or plain clock skew between
+			// this host and Redis) must not reach Set at all, or it
+			// would persist forever with nothing left to clean it up.
+			ttl := time.Until(record.ExpiresAt)
+			if ttl <= 0 {
+				return errMFARequestNotFound
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, newCiphertext, ttl)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			updated = &record
+
+			return nil
+		}, key)
+
+		if err == nil {
+			return updated, nil
+		}
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("mfa request %s: too much contention updating the record", reqID)
+}
+
+// Close releases the underlying Redis connection pool.
+func (s *redisMFARequestStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisMFARequestStore) encrypt(plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (s *redisMFARequestStore) decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("encrypted mfa request record is too short")
+	}
+
+	nonce, data := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	return s.aead.Open(nil, nonce, data, nil)
+}
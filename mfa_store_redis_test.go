@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisMFARequestStore builds a store with a dummy address: the
+// AEAD it sets up is fully testable without ever dialing Redis.
+func newTestRedisMFARequestStore(t *testing.T) *redisMFARequestStore {
+	t.Helper()
+
+	s, err := newRedisMFARequestStore(mfaRedisStoreConfig{Address: "127.0.0.1:0"}, []byte("a-cookie-signing-secret"))
+	if err != nil {
+		t.Fatalf("newRedisMFARequestStore() error = %v", err)
+	}
+
+	return s
+}
+
+func TestRedisMFARequestStoreEncryptDecryptRoundTrip(t *testing.T) {
+	s := newTestRedisMFARequestStore(t)
+
+	plain := []byte(`{"ID":"req-1","User":"alice"}`)
+
+	ciphertext, err := s.encrypt(plain)
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("alice")) {
+		t.Errorf("ciphertext leaks plaintext: %q", ciphertext)
+	}
+
+	got, err := s.decrypt(ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt() error = %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decrypt() = %q, want %q", got, plain)
+	}
+}
+
+func TestRedisMFARequestStoreDecryptRejectsTamperedCiphertext(t *testing.T) {
+	s := newTestRedisMFARequestStore(t)
+
+	ciphertext, err := s.encrypt([]byte(`{"ID":"req-1","User":"alice"}`))
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 0xFF
+
+	if _, err := s.decrypt(tampered); err == nil {
+		t.Error("decrypt() of tampered ciphertext succeeded, want error")
+	}
+}
+
+func TestRedisMFARequestStoreDecryptRejectsTooShortCiphertext(t *testing.T) {
+	s := newTestRedisMFARequestStore(t)
+
+	if _, err := s.decrypt([]byte("short")); err == nil {
+		t.Error("decrypt() of too-short ciphertext succeeded, want error")
+	}
+}
+
+func TestNewRedisMFARequestStoreRequiresSigningSecret(t *testing.T) {
+	if _, err := newRedisMFARequestStore(mfaRedisStoreConfig{Address: "127.0.0.1:0"}, nil); err == nil {
+		t.Error("newRedisMFARequestStore() with no signing secret succeeded, want error")
+	}
+}
+
+// newTestRedisMFARequestStoreWithServer builds a store backed by a real
+// (in-process, fake) Redis server, for the Put/Get/Update tests below
+// that need to observe actual key/TTL behavior rather than just the
+// AEAD helpers.
+func newTestRedisMFARequestStoreWithServer(t *testing.T) (*redisMFARequestStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	s, err := newRedisMFARequestStore(mfaRedisStoreConfig{Address: mr.Addr()}, []byte("a-cookie-signing-secret"))
+	if err != nil {
+		t.Fatalf("newRedisMFARequestStore() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, mr
+}
+
+func TestRedisMFARequestStorePutGetUpdateRoundTrip(t *testing.T) {
+	s, _ := newTestRedisMFARequestStoreWithServer(t)
+
+	pr := &mfaPendingRequest{ID: "req-1", User: "alice"}
+	if err := s.Put(pr.ID, pr, time.Minute); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, err := s.Get(pr.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.User != "alice" {
+		t.Errorf("Get().User = %q, want %q", got.User, "alice")
+	}
+
+	updated, err := s.Update(pr.ID, func(record *mfaPendingRequest) error {
+		record.User = "bob"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if updated.User != "bob" {
+		t.Errorf("Update() result User = %q, want %q", updated.User, "bob")
+	}
+
+	got, err = s.Get(pr.ID)
+	if err != nil {
+		t.Fatalf("Get() after Update() error = %v", err)
+	}
+	if got.User != "bob" {
+		t.Errorf("Get() after Update() User = %q, want %q", got.User, "bob")
+	}
+}
+
+// TestRedisMFARequestStoreUpdateRejectsAlreadyExpiredRecordInsteadOfPersistingForever
+// reproduces clock skew between the app host and the Redis host: the
+// record's own ExpiresAt has already passed by the app's clock, but the
+// Redis key itself is still alive (seeded here with a long TTL, the way
+// a Redis host lagging behind the app's clock would leave it). Update
+// must treat this as an expired record rather than handing
+// time.Until(record.ExpiresAt) to Set, which go-redis treats as "no
+// expiration" for any zero/negative value and would turn the key
+// permanent.
+func TestRedisMFARequestStoreUpdateRejectsAlreadyExpiredRecordInsteadOfPersistingForever(t *testing.T) {
+	s, mr := newTestRedisMFARequestStoreWithServer(t)
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice", ExpiresAt: time.Now().Add(-time.Minute)}
+
+	plain, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	ciphertext, err := s.encrypt(plain)
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+
+	key := mfaRedisKeyPrefix + record.ID
+	if err := s.client.Set(context.Background(), key, ciphertext, time.Hour).Err(); err != nil {
+		t.Fatalf("seeding redis key error = %v", err)
+	}
+
+	if _, err := s.Update(record.ID, func(r *mfaPendingRequest) error {
+		r.User = "mallory"
+		return nil
+	}); !errors.Is(err, errMFARequestNotFound) {
+		t.Fatalf("Update() on an already-expired record error = %v, want errMFARequestNotFound", err)
+	}
+
+	if !mr.Exists(key) {
+		t.Fatal("Update() on an already-expired record deleted the key outright, want it left alone with its original TTL")
+	}
+
+	if ttl := mr.TTL(key); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("key ttl after a rejected Update() = %v, want the pre-seeded ~1h TTL untouched (not rewritten to \"no expiration\")", ttl)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryMFARequestStorePutGetRoundTrip(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice"}
+
+	if err := s.Put(record.ID, record, time.Minute); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, err := s.Get(record.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.User != "alice" {
+		t.Errorf("Get() User = %q, want %q", got.User, "alice")
+	}
+
+	// The caller must not be able to mutate the stored record by holding
+	// on to either the record it Put or the record Get handed back.
+	record.User = "mallory"
+	got.User = "mallory"
+
+	again, err := s.Get(record.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if again.User != "alice" {
+		t.Errorf("Get() after external mutation = %q, want unaffected %q", again.User, "alice")
+	}
+}
+
+func TestMemoryMFARequestStoreGetMissing(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	if _, err := s.Get("does-not-exist"); err != errMFARequestNotFound {
+		t.Errorf("Get() error = %v, want %v", err, errMFARequestNotFound)
+	}
+}
+
+func TestMemoryMFARequestStoreExpiry(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice"}
+	if err := s.Put(record.ID, record, time.Millisecond); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := s.Get(record.ID); err != errMFARequestNotFound {
+		t.Errorf("Get() of an expired record error = %v, want %v", err, errMFARequestNotFound)
+	}
+}
+
+func TestMemoryMFARequestStoreDelete(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice"}
+	if err := s.Put(record.ID, record, time.Minute); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	if err := s.Delete(record.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := s.Get(record.ID); err != errMFARequestNotFound {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, errMFARequestNotFound)
+	}
+}
+
+func TestMemoryMFARequestStoreUpdateMissing(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	_, err := s.Update("does-not-exist", func(pr *mfaPendingRequest) error {
+		pr.User = "alice"
+		return nil
+	})
+	if err != errMFARequestNotFound {
+		t.Errorf("Update() error = %v, want %v", err, errMFARequestNotFound)
+	}
+}
+
+func TestMemoryMFARequestStoreUpdatePropagatesFnError(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice"}
+	if err := s.Put(record.ID, record, time.Minute); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	wantErr := errMFAMethodNotSupported
+	if _, err := s.Update(record.ID, func(pr *mfaPendingRequest) error { return wantErr }); err != wantErr {
+		t.Errorf("Update() error = %v, want %v", err, wantErr)
+	}
+
+	// A failed update must not have changed the stored record.
+	got, err := s.Get(record.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(got.Validations) != 0 {
+		t.Errorf("Get() after failed Update() Validations = %v, want none", got.Validations)
+	}
+}
+
+// TestMemoryMFARequestStoreUpdateIsAtomic drives many goroutines each
+// appending their own validation to the same pending request
+// concurrently, as /mfa/status and /mfa/validate would if two methods
+// were in flight for the same mfa_request_id at once. A Get-then-Put
+// pair would lose updates to this race; Update must not.
+func TestMemoryMFARequestStoreUpdateIsAtomic(t *testing.T) {
+	s := newMemoryMFARequestStore()
+	defer s.Close()
+
+	record := &mfaPendingRequest{ID: "req-1", User: "alice"}
+	if err := s.Put(record.ID, record, time.Minute); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	const n = 50
+
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			_, err := s.Update(record.ID, func(pr *mfaPendingRequest) error {
+				pr.Validations = append(pr.Validations, mfaValidation{ProviderID: "totp", Strength: i})
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Update() error = %v", err)
+			}
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+
+	got, err := s.Get(record.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(got.Validations) != n {
+		t.Errorf("Get() Validations count = %d, want %d (lost a concurrent update)", len(got.Validations), n)
+	}
+}
+
+func TestMemoryMFARequestStoreCloseIsIdempotent(t *testing.T) {
+	s := newMemoryMFARequestStore()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("first Close() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+}
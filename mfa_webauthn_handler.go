@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// mfaWebauthnRegistrationTTL bounds how long a started enrollment stays
+// valid waiting for its FinishRegistration call.
+const mfaWebauthnRegistrationTTL = 5 * time.Minute
+
+type webauthnRegistration struct {
+	user    string
+	session *webauthn.SessionData
+}
+
+var (
+	webauthnRegistrations      = map[string]webauthnRegistration{}
+	webauthnRegistrationsMutex sync.Mutex
+)
+
+type webauthnRegisterFinishRequest struct {
+	RegistrationID string          `json:"registration_id"`
+	Attestation    json.RawMessage `json:"attestation"`
+	Label          string          `json:"label"`
+}
+
+// handleWebauthnRegisterBegin implements POST /mfa/webauthn/register. It
+// requires an already-authenticated session (enrollment adds a second
+// factor, it is not itself a login path) and returns a
+// navigator.credentials.create() options object.
+func handleWebauthnRegisterBegin(res http.ResponseWriter, r *http.Request) {
+	user, err := authenticatedUserFromRequest(r)
+	if err != nil {
+		http.Error(res, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	provider, ok := findMFAProvider(mfaWebauthnProviderID)
+	if !ok {
+		http.Error(res, "webauthn provider not configured", http.StatusNotFound)
+		return
+	}
+
+	wa, ok := provider.(*mfaWebauthn)
+	if !ok {
+		http.Error(res, "webauthn provider not configured", http.StatusNotFound)
+		return
+	}
+
+	options, session, err := wa.wa.BeginRegistration(newWebauthnUser(user, nil))
+	if err != nil {
+		http.Error(res, "unable to begin registration", http.StatusInternalServerError)
+		return
+	}
+
+	regID, err := generateMFARequestID()
+	if err != nil {
+		http.Error(res, "unable to begin registration", http.StatusInternalServerError)
+		return
+	}
+
+	webauthnRegistrationsMutex.Lock()
+	webauthnRegistrations[regID] = webauthnRegistration{user: user, session: session}
+	webauthnRegistrationsMutex.Unlock()
+
+	time.AfterFunc(mfaWebauthnRegistrationTTL, func() {
+		webauthnRegistrationsMutex.Lock()
+		delete(webauthnRegistrations, regID)
+		webauthnRegistrationsMutex.Unlock()
+	})
+
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(struct {
+		RegistrationID string      `json:"registration_id"`
+		Challenge      interface{} `json:"challenge"`
+	}{RegistrationID: regID, Challenge: options.Response})
+}
+
+// handleWebauthnRegisterFinish implements the second half of the
+// enrollment flow: it verifies the attestation against the registration
+// session and hands back the mfaConfig the operator should persist for
+// the user (nginx-sso keeps user/MFA mappings in its static config, it
+// has no database to write the new authenticator to itself).
+func handleWebauthnRegisterFinish(res http.ResponseWriter, r *http.Request) {
+	user, err := authenticatedUserFromRequest(r)
+	if err != nil {
+		http.Error(res, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	var req webauthnRegisterFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(res, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	webauthnRegistrationsMutex.Lock()
+	reg, ok := webauthnRegistrations[req.RegistrationID]
+	if ok {
+		delete(webauthnRegistrations, req.RegistrationID)
+	}
+	webauthnRegistrationsMutex.Unlock()
+
+	if !ok || reg.user != user {
+		http.Error(res, "unknown or expired registration", http.StatusNotFound)
+		return
+	}
+
+	provider, ok := findMFAProvider(mfaWebauthnProviderID)
+	if !ok {
+		http.Error(res, "webauthn provider not configured", http.StatusNotFound)
+		return
+	}
+
+	wa, ok := provider.(*mfaWebauthn)
+	if !ok {
+		http.Error(res, "webauthn provider not configured", http.StatusNotFound)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(req.Attestation))
+	if err != nil {
+		http.Error(res, "invalid attestation", http.StatusBadRequest)
+		return
+	}
+
+	cred, err := wa.wa.CreateCredential(newWebauthnUser(user, nil), *reg.session, parsed)
+	if err != nil {
+		http.Error(res, "attestation verification failed", http.StatusForbidden)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(newWebauthnMFAConfig(cred, req.Label))
+}
+
+// newWebauthnMFAConfig builds the mfaConfig entry an operator needs to
+// add to a user's config.yaml to complete enrollment of cred.
+func newWebauthnMFAConfig(cred *webauthn.Credential, label string) mfaConfig {
+	return mfaConfig{
+		Provider: mfaWebauthnProviderID,
+		Attributes: map[string]interface{}{
+			"label":         label,
+			"credential_id": base64Encode(cred.ID),
+			"public_key":    base64Encode(cred.PublicKey),
+			"sign_count":    int(cred.Authenticator.SignCount),
+			"aaguid":        base64Encode(cred.Authenticator.AAGUID),
+		},
+	}
+}